@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+)
+
+// ErrNoSupportedAuthMechanism is returned by login when none of the
+// mechanisms the upstream advertised in its AUTH extension are supported by
+// this package (or by the configured AuthFunc/AuthMechanism).
+var ErrNoSupportedAuthMechanism = errors.New("smtp-proxy: upstream does not advertise a supported AUTH mechanism")
+
+// preferredMechanisms lists the mechanisms selectAuthClient picks between
+// when Backend.AuthMechanism is not set, in descending order of preference.
+// XOAUTH2 is deliberately excluded: it expects password to be an OAuth2
+// access token rather than a regular password, so it's only used when
+// requested explicitly via Backend.AuthMechanism.
+var preferredMechanisms = []string{"CRAM-MD5", "PLAIN", "LOGIN"}
+
+// AuthFunc selects the SASL client used to authenticate to the upstream
+// server. advertised is the list of mechanisms the upstream listed in its
+// AUTH EHLO extension. A nil return aborts the login with
+// ErrNoSupportedAuthMechanism.
+type AuthFunc func(username, password string, advertised []string) sasl.Client
+
+// selectAuthClient is the default AuthFunc. It honors Backend.AuthMechanism
+// when set, otherwise it picks the strongest mechanism that is both
+// advertised by the upstream and supported by this package.
+func (be *Backend) selectAuthClient(username, password string, advertised []string) sasl.Client {
+	if be.AuthMechanism != "" {
+		if !mechanismAdvertised(advertised, be.AuthMechanism) {
+			return nil
+		}
+		return newAuthClient(be.AuthMechanism, username, password)
+	}
+
+	for _, mech := range preferredMechanisms {
+		if mechanismAdvertised(advertised, mech) {
+			return newAuthClient(mech, username, password)
+		}
+	}
+
+	return nil
+}
+
+func mechanismAdvertised(advertised []string, mech string) bool {
+	for _, a := range advertised {
+		if strings.EqualFold(a, mech) {
+			return true
+		}
+	}
+	return false
+}
+
+// newAuthClient builds a sasl.Client for mech, or nil if mech is unknown.
+func newAuthClient(mech, username, password string) sasl.Client {
+	switch strings.ToUpper(mech) {
+	case "CRAM-MD5":
+		return newCRAMMD5Client(username, password)
+	case "XOAUTH2":
+		return newXOAUTH2Client(username, password)
+	case "LOGIN":
+		return sasl.NewLoginClient(username, password)
+	case "PLAIN":
+		return sasl.NewPlainClient("", username, password)
+	default:
+		return nil
+	}
+}
+
+// cramMD5Client implements the CRAM-MD5 mechanism (RFC 2195). go-sasl
+// doesn't ship one, so it's implemented here: it's a simple HMAC-MD5
+// challenge-response over the password, so it avoids sending the password
+// in the clear.
+type cramMD5Client struct {
+	username string
+	password string
+}
+
+func newCRAMMD5Client(username, password string) sasl.Client {
+	return &cramMD5Client{username: username, password: password}
+}
+
+func (c *cramMD5Client) Start() (mech string, ir []byte, err error) {
+	return "CRAM-MD5", nil, nil
+}
+
+func (c *cramMD5Client) Next(challenge []byte) ([]byte, error) {
+	if challenge == nil {
+		return nil, errors.New("smtp-proxy: unexpected empty CRAM-MD5 challenge")
+	}
+
+	mac := hmac.New(md5.New, []byte(c.password))
+	mac.Write(challenge)
+	digest := hex.EncodeToString(mac.Sum(nil))
+
+	return []byte(c.username + " " + digest), nil
+}
+
+// xoauth2Client implements Google's XOAUTH2 mechanism. It predates, and is
+// distinct from, the OAUTHBEARER mechanism (RFC 7628) go-sasl already
+// provides. password is taken to be an OAuth2 access token, not a regular
+// password.
+type xoauth2Client struct {
+	username string
+	token    string
+}
+
+func newXOAUTH2Client(username, token string) sasl.Client {
+	return &xoauth2Client{username: username, token: token}
+}
+
+func (c *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	ir = []byte("user=" + c.username + "\x01auth=Bearer " + c.token + "\x01\x01")
+	return "XOAUTH2", ir, nil
+}
+
+func (c *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	// The server responded with an error as the challenge; the client must
+	// reply with an empty response to complete the (failed) exchange.
+	return []byte{}, nil
+}
@@ -2,22 +2,58 @@ package proxy
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"net"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 )
 
-type Security int
+// TLSPolicy controls how newConn negotiates TLS with the upstream server.
+// It is modeled on go-mail's TLSPolicy.
+type TLSPolicy int
 
 const (
-	SecurityTLS Security = iota
-	SecurityStartTLS
-	SecurityNone
+	// NoTLS never attempts TLS, even if the upstream advertises STARTTLS.
+	NoTLS TLSPolicy = iota
+	// TLSOpportunistic issues STARTTLS if the upstream's EHLO advertises
+	// the extension, and silently continues in plaintext if it doesn't.
+	TLSOpportunistic
+	// TLSMandatory requires the upstream to advertise STARTTLS and aborts
+	// the connection with ErrSTARTTLSUnsupported if it doesn't.
+	TLSMandatory
+	// TLSStrict behaves like TLSMandatory but additionally aborts the
+	// connection if the upstream's certificate fails verification, even
+	// when TLSConfig.InsecureSkipVerify is set.
+	TLSStrict
+	// ImplicitTLS dials the upstream directly over TLS (SMTPS/LMTPS)
+	// instead of issuing STARTTLS after connecting in plaintext.
+	ImplicitTLS
 )
 
+// ErrSTARTTLSUnsupported is returned by newConn when TLSMandatory or
+// TLSStrict is configured but the upstream does not advertise the STARTTLS
+// extension.
+var ErrSTARTTLSUnsupported = &smtp.SMTPError{
+	Code:         454,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+	Message:      "smtp-proxy: upstream does not support STARTTLS",
+}
+
+// ErrCertificateVerification is returned by newConn when TLSStrict is
+// configured together with TLSConfig.InsecureSkipVerify and the upstream's
+// certificate fails the verification newConn then runs itself. Without
+// InsecureSkipVerify, a bad certificate fails the TLS handshake in StartTLS
+// and newConn returns that handshake error instead.
+var ErrCertificateVerification = &smtp.SMTPError{
+	Code:         454,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 4},
+	Message:      "smtp-proxy: upstream certificate verification failed",
+}
+
 var (
 	// 30 seconds was chosen as it's the
 	// same duration as http.DefaultTransport's timeout.
@@ -32,8 +68,24 @@ var (
 )
 
 type Backend struct {
-	Addr              string
-	Security          Security
+	Addr  string
+	Addrs []string
+	// Strategy selects the order Addrs is tried in. Ignored unless Addrs
+	// has more than one entry.
+	Strategy Strategy
+	// Weights holds the per-address weight used by the Weighted strategy,
+	// keyed by the entries in Addrs. Addresses missing from the map
+	// default to weight 1.
+	Weights map[string]int
+	// FailureThreshold is the number of consecutive connection failures
+	// an upstream must accumulate before its circuit breaker opens and it
+	// is skipped for CooldownWindow. Zero disables the breaker.
+	FailureThreshold int
+	// CooldownWindow is how long a tripped upstream is skipped before
+	// being tried again.
+	CooldownWindow time.Duration
+
+	TLSPolicy         TLSPolicy
 	TLSConfig         *tls.Config
 	LMTP              bool
 	Host              string
@@ -42,31 +94,103 @@ type Backend struct {
 	CommandTimeout    time.Duration
 	SubmissionTimeout time.Duration
 
+	// MaxIdle is the maximum number of idle upstream connections kept
+	// around per (username, password) pair (or, for anonymous logins, in
+	// the single shared pool). Zero means connections are closed with
+	// QUIT instead of being pooled.
+	MaxIdle int
+	// MaxActive is the maximum number of upstream connections allocated
+	// per pool at any one time. Zero means no limit.
+	MaxActive int
+	// IdleTimeout closes pooled connections that have been idle longer
+	// than this duration.
+	IdleTimeout time.Duration
+
+	// AuthMechanism pins the SASL mechanism used against the upstream
+	// (e.g. "PLAIN", "LOGIN", "CRAM-MD5", "XOAUTH2"). If empty, the
+	// strongest of CRAM-MD5, PLAIN and LOGIN that the upstream advertises
+	// is picked automatically; XOAUTH2 is only used when named here.
+	// Ignored if AuthFunc is set.
+	AuthMechanism string
+	// AuthFunc, if set, overrides mechanism selection entirely.
+	AuthFunc AuthFunc
+
+	// ForwardClient enables sending Postfix's XCLIENT command to upstreams
+	// that advertise it, preserving the original client's IP, HELO name
+	// and SASL identity across the proxy hop. A pooled connection is
+	// re-synced with XCLIENT on every checkout, so a connection reused by a
+	// different session (e.g. one sharing credentials with, but not the IP
+	// of, whoever first dialed it) still forwards its own identity.
+	ForwardClient bool
+	// TrustedClientHeaderFunc, if set, lets operators redact or rewrite
+	// the XCLIENT attributes before they're sent upstream.
+	TrustedClientHeaderFunc TrustedClientHeaderFunc
+
+	mu        sync.Mutex
+	pools     map[poolKey]*connPool
+	anonPool  *connPool
+	breakers  map[string]*circuitBreaker
+	rrCounter uint64
+
 	unexported struct{}
 }
 
+// poolKey identifies the connection pool an authenticated session's
+// connections are drawn from.
+type poolKey struct {
+	username string
+	password string
+}
+
+// upstreamConn pairs a dialed smtp.Client with its underlying net.Conn, so
+// that session can set I/O deadlines on the raw connection directly (e.g.
+// around the DATA body transfer, which bypasses the client's own timeouts).
+type upstreamConn struct {
+	client *smtp.Client
+	conn   net.Conn
+	// postXCLIENTExt holds the extensions re-advertised in the EHLO that
+	// sendXCLIENT re-issues, parsed from the raw reply since the vendored
+	// go-smtp client has no exported way to refresh its own cached
+	// extension map. Nil unless XCLIENT was actually sent. login uses this
+	// in preference to Client.Extension("AUTH"), which otherwise still
+	// reflects the pre-XCLIENT EHLO and can offer mechanisms the upstream
+	// wouldn't actually accept (or omit ones it now would) once it's seen
+	// the real client identity.
+	postXCLIENTExt map[string]string
+}
+
+// Close closes the underlying connection via the client, tolerating a nil
+// client for partially-constructed upstreamConns returned alongside a dial
+// error.
+func (uc *upstreamConn) Close() error {
+	if uc == nil || uc.client == nil {
+		return nil
+	}
+	return uc.client.Close()
+}
+
 func New(addr string) *Backend {
-	return &Backend{Addr: addr, Security: SecurityStartTLS}
+	return &Backend{Addr: addr, TLSPolicy: TLSOpportunistic}
 }
 
 func NewTLS(addr string, tlsConfig *tls.Config) *Backend {
 	return &Backend{
 		Addr:      addr,
-		Security:  SecurityTLS,
+		TLSPolicy: ImplicitTLS,
 		TLSConfig: tlsConfig,
 	}
 }
 
 func NewLMTP(addr string, host string) *Backend {
 	return &Backend{
-		Addr:     addr,
-		Security: SecurityNone,
-		LMTP:     true,
-		Host:     host,
+		Addr:      addr,
+		TLSPolicy: NoTLS,
+		LMTP:      true,
+		Host:      host,
 	}
 }
 
-func (be *Backend) newConn() (*smtp.Client, error) {
+func (be *Backend) newConn(addr string, state *smtp.ConnectionState, username string) (*upstreamConn, error) {
 	var conn net.Conn
 	var err error
 
@@ -85,7 +209,7 @@ func (be *Backend) newConn() (*smtp.Client, error) {
 
 	host := be.Host
 	if host == "" {
-		host, _, _ = net.SplitHostPort(be.Addr)
+		host, _, _ = net.SplitHostPort(addr)
 	}
 	var tlsConfig *tls.Config
 	if be.TLSConfig == nil {
@@ -98,20 +222,20 @@ func (be *Backend) newConn() (*smtp.Client, error) {
 	}
 
 	if be.LMTP {
-		if be.Security != SecurityNone {
+		if be.TLSPolicy != NoTLS {
 			return nil, errors.New("smtp-proxy: LMTP doesn't support TLS")
 		}
-		conn, err = net.DialTimeout("tcp", be.Addr, dialTimeout)
-	} else if be.Security == SecurityTLS {
+		conn, err = net.DialTimeout("tcp", addr, dialTimeout)
+	} else if be.TLSPolicy == ImplicitTLS {
 		tlsDialer := tls.Dialer{
 			NetDialer: &net.Dialer{
 				Timeout: dialTimeout,
 			},
 			Config: tlsConfig,
 		}
-		conn, err = tlsDialer.Dial("tcp", be.Addr)
+		conn, err = tlsDialer.Dial("tcp", addr)
 	} else {
-		conn, err = net.DialTimeout("tcp", be.Addr, dialTimeout)
+		conn, err = net.DialTimeout("tcp", addr, dialTimeout)
 	}
 	if err != nil {
 		return nil, err
@@ -127,68 +251,202 @@ func (be *Backend) newConn() (*smtp.Client, error) {
 		}
 		err = c.InitConn(conn)
 	}
+	uc := &upstreamConn{client: c, conn: conn}
 	if err != nil {
-		return c, err
+		return uc, err
 	}
 
 	if be.LocalName != "" {
 		err = c.Hello(be.LocalName)
 		if err != nil {
-			return c, err
+			return uc, err
 		}
 	}
 
-	if be.Security == SecurityStartTLS {
+	switch be.TLSPolicy {
+	case TLSOpportunistic, TLSMandatory, TLSStrict:
+		ok, _ := c.Extension("STARTTLS")
+		if !ok {
+			if be.TLSPolicy == TLSOpportunistic {
+				break
+			}
+			return uc, ErrSTARTTLSUnsupported
+		}
+
 		if err := c.StartTLS(tlsConfig); err != nil {
-			return c, err
+			return uc, err
+		}
+
+		if be.TLSPolicy == TLSStrict && tlsConfig.InsecureSkipVerify {
+			if err := verifyConnState(c, tlsConfig); err != nil {
+				return uc, err
+			}
 		}
 	}
 
-	return c, nil
+	if be.ForwardClient {
+		if ok, _ := c.Extension("XCLIENT"); ok {
+			localName := be.LocalName
+			if localName == "" {
+				localName = "localhost"
+			}
+			ext, err := sendXCLIENT(c, localName, be.clientAttrs(state, username))
+			if err != nil {
+				return uc, err
+			}
+			uc.postXCLIENTExt = ext
+		}
+	}
+
+	return uc, nil
 }
 
-func (be *Backend) login(username, password string) (*smtp.Client, error) {
-	c, err := be.newConn()
+// verifyConnState re-verifies the upstream's certificate chain against
+// tlsConfig, bypassing the fact that InsecureSkipVerify disabled the
+// automatic verification normally performed during the TLS handshake.
+func verifyConnState(c *smtp.Client, tlsConfig *tls.Config) error {
+	state, ok := c.TLSConnectionState()
+	if !ok || len(state.PeerCertificates) == 0 {
+		return ErrCertificateVerification
+	}
+
+	opts := x509.VerifyOptions{
+		DNSName:       tlsConfig.ServerName,
+		Roots:         tlsConfig.RootCAs,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := state.PeerCertificates[0].Verify(opts); err != nil {
+		return ErrCertificateVerification
+	}
+
+	return nil
+}
+
+func (be *Backend) login(username, password string, state *smtp.ConnectionState) (*upstreamConn, error) {
+	uc, err := be.dialUpstream(state, username)
 	if err != nil {
-		return c, err
+		return uc, err
+	}
+
+	// If XCLIENT was sent, the upstream has seen the real client identity
+	// and may advertise a different AUTH mechanism list than it offered the
+	// proxy's own un-spoofed connection; uc.postXCLIENTExt carries that
+	// post-XCLIENT list since the client's own cached extensions don't get
+	// refreshed. Otherwise fall back to the client's normal cached list.
+	var advertised []string
+	if uc.postXCLIENTExt != nil {
+		advertised = strings.Fields(uc.postXCLIENTExt["AUTH"])
+	} else if ok, param := uc.client.Extension("AUTH"); ok {
+		advertised = strings.Fields(param)
+	}
+
+	authFunc := be.AuthFunc
+	if authFunc == nil {
+		authFunc = be.selectAuthClient
+	}
+
+	auth := authFunc(username, password, advertised)
+	if auth == nil {
+		return uc, ErrNoSupportedAuthMechanism
 	}
 
-	auth := sasl.NewPlainClient("", username, password)
-	if err := c.Auth(auth); err != nil {
-		return c, err
+	if err := uc.client.Auth(auth); err != nil {
+		return uc, err
 	}
 
-	return c, nil
+	return uc, nil
+}
+
+// pool returns the connection pool for key, creating it on first use. The
+// pool's dialer is bound to key's username/password, but not to any single
+// session's ConnectionState: that's supplied fresh on every Get so a pool
+// shared by multiple sessions using the same credentials doesn't pin
+// session-specific state to whichever one dialed first.
+func (be *Backend) pool(key poolKey) *connPool {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	if be.pools == nil {
+		be.pools = make(map[poolKey]*connPool)
+	}
+	p, ok := be.pools[key]
+	if !ok {
+		factory := func(state *smtp.ConnectionState, username string) (*upstreamConn, error) {
+			return be.login(key.username, key.password, state)
+		}
+		p = newConnPool(factory, be.xclientRefresh, be.MaxIdle, be.MaxActive, be.IdleTimeout, testOnBorrow)
+		be.pools[key] = p
+	}
+	return p
+}
+
+// anonymousPool returns the single pool shared by anonymous logins, creating
+// it on first use.
+func (be *Backend) anonymousPool() *connPool {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	if be.anonPool == nil {
+		be.anonPool = newConnPool(be.dialUpstream, be.xclientRefresh, be.MaxIdle, be.MaxActive, be.IdleTimeout, testOnBorrow)
+	}
+	return be.anonPool
+}
+
+// xclientRefresh re-sends XCLIENT on a connection pulled from the idle list,
+// using state/username for the session now borrowing it. Without this, a
+// pooled connection keeps forwarding the identity of whichever session first
+// dialed it to every later session that reuses it from the same pool.
+func (be *Backend) xclientRefresh(c *upstreamConn, state *smtp.ConnectionState, username string) error {
+	if !be.ForwardClient {
+		return nil
+	}
+	if ok, _ := c.client.Extension("XCLIENT"); !ok {
+		return nil
+	}
+	localName := be.LocalName
+	if localName == "" {
+		localName = "localhost"
+	}
+	ext, err := sendXCLIENT(c.client, localName, be.clientAttrs(state, username))
+	if err != nil {
+		return err
+	}
+	c.postXCLIENTExt = ext
+	return nil
 }
 
 func (be *Backend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
-	c, err := be.login(username, password)
+	key := poolKey{username: username, password: password}
+	p := be.pool(key)
+
+	uc, err := p.Get(state, username)
 	if err != nil {
-		if c != nil {
-			c.Close()
-		}
 		return nil, err
 	}
 
 	s := &session{
-		c:  c,
-		be: be,
+		uc:   uc,
+		be:   be,
+		pool: p,
 	}
 	return s, nil
 }
 
 func (be *Backend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
-	c, err := be.newConn()
+	p := be.anonymousPool()
+
+	uc, err := p.Get(state, "")
 	if err != nil {
-		if c != nil {
-			c.Close()
-		}
 		return nil, err
 	}
 
 	s := &session{
-		c:  c,
-		be: be,
+		uc:   uc,
+		be:   be,
+		pool: p,
 	}
 	return s, nil
 }
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Strategy selects the order in which Backend.Addrs is tried when more than
+// one upstream relay is configured.
+type Strategy int
+
+const (
+	// RoundRobin cycles through Addrs, advancing one entry per dial
+	// attempt.
+	RoundRobin Strategy = iota
+	// Random tries Addrs in a random order.
+	Random
+	// Priority always tries Addrs in the order given, falling back to a
+	// later entry only if an earlier one fails.
+	Priority
+	// Weighted tries Addrs in an order randomly weighted by Backend.Weights
+	// (entries missing from Weights default to weight 1).
+	Weighted
+)
+
+// ErrNoUpstreamAddrs is returned by dialUpstream when Backend has no
+// upstream address configured.
+var ErrNoUpstreamAddrs = errors.New("smtp-proxy: no upstream addresses configured")
+
+// addrs returns the configured upstream addresses, falling back to the
+// single Addr field if Addrs isn't set.
+func (be *Backend) addrs() []string {
+	if len(be.Addrs) > 0 {
+		return be.Addrs
+	}
+	if be.Addr != "" {
+		return []string{be.Addr}
+	}
+	return nil
+}
+
+// orderedAddrs arranges the configured addresses according to Strategy for a
+// single dial attempt.
+func (be *Backend) orderedAddrs() []string {
+	addrs := be.addrs()
+	ordered := make([]string, len(addrs))
+	copy(ordered, addrs)
+
+	switch be.Strategy {
+	case RoundRobin:
+		if n := len(ordered); n > 0 {
+			start := int(atomic.AddUint64(&be.rrCounter, 1)-1) % n
+			ordered = append(ordered[start:], ordered[:start]...)
+		}
+	case Random:
+		rand.Shuffle(len(ordered), func(i, j int) {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		})
+	case Weighted:
+		ordered = weightedOrder(ordered, be.Weights)
+	case Priority:
+		// Already in the configured order.
+	}
+
+	return ordered
+}
+
+// weightedOrder repeatedly draws a random remaining address, weighted by
+// weights, without replacement.
+func weightedOrder(addrs []string, weights map[string]int) []string {
+	remaining := append([]string(nil), addrs...)
+	order := make([]string, 0, len(addrs))
+
+	for len(remaining) > 0 {
+		total := 0
+		for _, a := range remaining {
+			total += weightOf(weights, a)
+		}
+
+		pick := rand.Intn(total)
+		for i, a := range remaining {
+			pick -= weightOf(weights, a)
+			if pick < 0 {
+				order = append(order, a)
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return order
+}
+
+func weightOf(weights map[string]int, addr string) int {
+	if w, ok := weights[addr]; ok && w > 0 {
+		return w
+	}
+	return 1
+}
+
+// circuitBreaker skips an upstream for CooldownWindow once it has
+// accumulated FailureThreshold consecutive connection failures.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func (b *circuitBreaker) open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openUntil.IsZero() && time.Now().Before(b.openUntil)
+}
+
+func (b *circuitBreaker) recordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+}
+
+func (b *circuitBreaker) recordFailure(threshold int, cooldown time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if threshold <= 0 {
+		return
+	}
+	b.failures++
+	if b.failures >= threshold {
+		b.openUntil = time.Now().Add(cooldown)
+	}
+}
+
+// breaker returns the circuit breaker for addr, creating it on first use.
+func (be *Backend) breaker(addr string) *circuitBreaker {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	if be.breakers == nil {
+		be.breakers = make(map[string]*circuitBreaker)
+	}
+	b, ok := be.breakers[addr]
+	if !ok {
+		b = &circuitBreaker{}
+		be.breakers[addr] = b
+	}
+	return b
+}
+
+// isRetryable reports whether a newConn failure should be tried again
+// against the next candidate upstream. SMTP errors with a 4xx code (and
+// bare network errors, which have none) are transient; a 5xx code is a
+// permanent rejection and short-circuits the failover loop.
+func isRetryable(err error) bool {
+	if smtpErr, ok := err.(*smtp.SMTPError); ok {
+		return smtpErr.Code/100 == 4
+	}
+	return true
+}
+
+// dialUpstream tries the configured upstream addresses, in the order given
+// by Strategy, skipping any whose circuit breaker is open. It returns the
+// first successful connection, or the last error seen if every candidate
+// failed.
+func (be *Backend) dialUpstream(state *smtp.ConnectionState, username string) (*upstreamConn, error) {
+	addrs := be.orderedAddrs()
+	if len(addrs) == 0 {
+		return nil, ErrNoUpstreamAddrs
+	}
+
+	var lastErr error = ErrNoUpstreamAddrs
+	for _, addr := range addrs {
+		b := be.breaker(addr)
+		if b.open() {
+			continue
+		}
+
+		c, err := be.newConn(addr, state, username)
+		if err == nil {
+			b.recordSuccess()
+			return c, nil
+		}
+		if c != nil {
+			// newConn can return a partially-constructed connection
+			// alongside an error (e.g. STARTTLS or XCLIENT failed after
+			// the socket was already open); close it before trying the
+			// next candidate instead of leaking it.
+			c.Close()
+		}
+
+		lastErr = err
+		if !isRetryable(err) {
+			return nil, err
+		}
+		b.recordFailure(be.FailureThreshold, be.CooldownWindow)
+	}
+
+	return nil, lastErr
+}
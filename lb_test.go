@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestOrderedAddrsPriorityKeepsConfiguredOrder(t *testing.T) {
+	be := &Backend{Addrs: []string{"a", "b", "c"}, Strategy: Priority}
+
+	for i := 0; i < 3; i++ {
+		got := be.orderedAddrs()
+		want := []string{"a", "b", "c"}
+		for j := range want {
+			if got[j] != want[j] {
+				t.Fatalf("Priority strategy reordered addrs: got %v, want %v", got, want)
+			}
+		}
+	}
+}
+
+func TestOrderedAddrsRoundRobinAdvances(t *testing.T) {
+	be := &Backend{Addrs: []string{"a", "b", "c"}, Strategy: RoundRobin}
+
+	first := be.orderedAddrs()
+	second := be.orderedAddrs()
+	third := be.orderedAddrs()
+	fourth := be.orderedAddrs()
+
+	if first[0] == second[0] || second[0] == third[0] {
+		t.Fatalf("expected RoundRobin to advance the starting address each call: %v, %v, %v", first, second, third)
+	}
+	if fourth[0] != first[0] {
+		t.Fatalf("expected RoundRobin to wrap back around after len(Addrs) calls: got %v, want start %v", fourth, first[0])
+	}
+}
+
+func TestWeightedOrderFavorsHigherWeight(t *testing.T) {
+	addrs := []string{"light", "heavy"}
+	weights := map[string]int{"light": 1, "heavy": 99}
+
+	heavyFirst := 0
+	for i := 0; i < 200; i++ {
+		order := weightedOrder(addrs, weights)
+		if len(order) != len(addrs) {
+			t.Fatalf("weightedOrder dropped an address: got %v", order)
+		}
+		if order[0] == "heavy" {
+			heavyFirst++
+		}
+	}
+	if heavyFirst < 150 {
+		t.Fatalf("expected the heavily-weighted address to sort first most of the time, got %d/200", heavyFirst)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"bare network error", errors.New("network blip"), true},
+		{"4xx SMTP error", &smtp.SMTPError{Code: 450}, true},
+		{"5xx SMTP error", &smtp.SMTPError{Code: 550}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isRetryable(c.err); got != c.want {
+				t.Fatalf("isRetryable(%v) = %v, want %v", c.err, got, c.want)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerOpensAfterThresholdAndResetsOnSuccess(t *testing.T) {
+	b := &circuitBreaker{}
+
+	b.recordFailure(2, time.Minute)
+	if b.open() {
+		t.Fatalf("breaker should stay closed before reaching the threshold")
+	}
+
+	b.recordFailure(2, time.Minute)
+	if !b.open() {
+		t.Fatalf("breaker should open once the threshold is reached")
+	}
+
+	b.recordSuccess()
+	if b.open() {
+		t.Fatalf("recordSuccess should reset the breaker")
+	}
+}
+
+func TestCircuitBreakerDisabledWhenThresholdIsZero(t *testing.T) {
+	b := &circuitBreaker{}
+
+	for i := 0; i < 10; i++ {
+		b.recordFailure(0, time.Minute)
+	}
+	if b.open() {
+		t.Fatalf("a zero FailureThreshold should disable the breaker")
+	}
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// connFactory dials and authenticates a new upstream connection for the
+// given session's connection state and username. It is the pool's New func,
+// analogous to redigo's Pool.Dial, but takes state/username as arguments
+// rather than closing over them: a pool is shared across every session with
+// the same key (e.g. same credentials, or the anonymous pool), so baking in
+// whichever session happened to create the pool would freeze state for
+// everyone who shares it afterwards.
+type connFactory func(state *smtp.ConnectionState, username string) (*upstreamConn, error)
+
+// refreshFunc re-synchronizes an idle connection pulled out of the pool with
+// the current session's state/username (e.g. re-sending XCLIENT), since that
+// connection may have been dialed by a different session sharing the same
+// pool key.
+type refreshFunc func(c *upstreamConn, state *smtp.ConnectionState, username string) error
+
+// idleConn is a connection sitting idle in the pool, together with the time
+// it was returned so IdleTimeout can be enforced on the next Get.
+type idleConn struct {
+	c *upstreamConn
+	t time.Time
+}
+
+// connPool is a minimal connection pool modeled on the Redigo pool: it keeps
+// up to MaxIdle idle connections around, limits the number of connections it
+// has allocated (idle or in use) to MaxActive, and runs TestOnBorrow against a
+// connection pulled from
+// the idle list before handing it back out.
+type connPool struct {
+	// New dials and authenticates a fresh connection.
+	New connFactory
+	// TestOnBorrow, if set, is called on a connection taken from the idle
+	// list before it is returned from Get. If it returns an error, the
+	// connection is closed and a new one is taken/dialed instead.
+	TestOnBorrow func(c *upstreamConn, t time.Time) error
+	// Refresh, if set, is called on a connection taken from the idle list
+	// (after TestOnBorrow) with the state/username of the session now
+	// borrowing it, so state that needs to track the current session (e.g.
+	// XCLIENT) doesn't stay pinned to whichever session first dialed the
+	// connection. If it returns an error, the connection is closed and a
+	// new one is taken/dialed instead.
+	Refresh refreshFunc
+	// MaxIdle is the maximum number of idle connections kept in the pool.
+	// Zero means no idle connections are retained.
+	MaxIdle int
+	// MaxActive is the maximum number of connections (idle or in use)
+	// allocated by the pool at any one time. Zero means no limit.
+	MaxActive int
+	// IdleTimeout closes connections that have been idle longer than this
+	// duration. Zero means idle connections never expire on their own.
+	IdleTimeout time.Duration
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	idle   list.List
+	active int
+}
+
+func newConnPool(factory connFactory, refresh refreshFunc, maxIdle, maxActive int, idleTimeout time.Duration, testOnBorrow func(c *upstreamConn, t time.Time) error) *connPool {
+	p := &connPool{
+		New:          factory,
+		TestOnBorrow: testOnBorrow,
+		Refresh:      refresh,
+		MaxIdle:      maxIdle,
+		MaxActive:    maxActive,
+		IdleTimeout:  idleTimeout,
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// Get returns a connection from the idle list, testing and refreshing it
+// first, or dials a new one via New(state, username). It blocks if MaxActive
+// connections are already allocated.
+func (p *connPool) Get(state *smtp.ConnectionState, username string) (*upstreamConn, error) {
+	p.mu.Lock()
+	for {
+		if e := p.idle.Front(); e != nil {
+			ic := e.Value.(*idleConn)
+			p.idle.Remove(e)
+
+			expired := p.IdleTimeout > 0 && time.Since(ic.t) > p.IdleTimeout
+			if !expired && p.TestOnBorrow != nil {
+				if err := p.TestOnBorrow(ic.c, ic.t); err != nil {
+					expired = true
+				}
+			}
+			if !expired && p.Refresh != nil {
+				if err := p.Refresh(ic.c, state, username); err != nil {
+					expired = true
+				}
+			}
+			if expired {
+				p.active--
+				p.mu.Unlock()
+				ic.c.Close()
+				p.mu.Lock()
+				continue
+			}
+
+			p.mu.Unlock()
+			return ic.c, nil
+		}
+
+		if p.MaxActive > 0 && p.active >= p.MaxActive {
+			p.cond.Wait()
+			continue
+		}
+
+		p.active++
+		p.mu.Unlock()
+
+		c, err := p.New(state, username)
+		if err != nil {
+			if c != nil {
+				// New can return a partially-constructed connection
+				// alongside an error (e.g. auth failed after the socket
+				// and TLS handshake succeeded); close it rather than
+				// leaking it.
+				c.Close()
+			}
+			p.mu.Lock()
+			p.active--
+			p.cond.Signal()
+			p.mu.Unlock()
+			return nil, err
+		}
+		return c, nil
+	}
+}
+
+// Put returns c to the pool so it can be reused by a later Get, unless
+// forceClose is set or the idle list is already at MaxIdle, in which case it
+// is closed instead.
+func (p *connPool) Put(c *upstreamConn, forceClose bool) {
+	p.mu.Lock()
+	doClose := forceClose || (p.MaxIdle > 0 && p.idle.Len() >= p.MaxIdle) || p.MaxIdle == 0
+	if !doClose {
+		p.idle.PushFront(&idleConn{c: c, t: time.Now()})
+	} else {
+		p.active--
+	}
+	p.cond.Signal()
+	p.mu.Unlock()
+
+	if doClose {
+		c.Close()
+	}
+}
+
+// testOnBorrow is the default TestOnBorrow hook: it pings the upstream with
+// NOOP to make sure the connection is still alive before it's reused.
+func testOnBorrow(c *upstreamConn, t time.Time) error {
+	return c.client.Noop()
+}
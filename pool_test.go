@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestConnPoolGetReusesPutConnections(t *testing.T) {
+	dials := 0
+	factory := func(state *smtp.ConnectionState, username string) (*upstreamConn, error) {
+		dials++
+		return &upstreamConn{}, nil
+	}
+	p := newConnPool(factory, nil, 1, 0, 0, nil)
+
+	c1, err := p.Get(nil, "")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	p.Put(c1, false)
+
+	c2, err := p.Get(nil, "")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if c2 != c1 {
+		t.Fatalf("expected Get to reuse the connection returned by Put")
+	}
+	if dials != 1 {
+		t.Fatalf("expected exactly one dial, got %d", dials)
+	}
+}
+
+func TestConnPoolPutClosesBeyondMaxIdle(t *testing.T) {
+	factory := func(state *smtp.ConnectionState, username string) (*upstreamConn, error) {
+		return &upstreamConn{}, nil
+	}
+	p := newConnPool(factory, nil, 0, 0, 0, nil)
+
+	c, err := p.Get(nil, "")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	p.Put(c, false)
+
+	if p.idle.Len() != 0 {
+		t.Fatalf("expected MaxIdle=0 to close the connection instead of pooling it")
+	}
+	if p.active != 0 {
+		t.Fatalf("expected active count to drop back to 0 after Put, got %d", p.active)
+	}
+}
+
+func TestConnPoolGetBlocksUntilMaxActiveFrees(t *testing.T) {
+	factory := func(state *smtp.ConnectionState, username string) (*upstreamConn, error) {
+		return &upstreamConn{}, nil
+	}
+	p := newConnPool(factory, nil, 0, 1, 0, nil)
+
+	c1, err := p.Get(nil, "")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	done := make(chan *upstreamConn, 1)
+	go func() {
+		c, err := p.Get(nil, "")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		done <- c
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("expected second Get to block while MaxActive=1 is exhausted")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	p.Put(c1, true)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected second Get to unblock once the first connection was returned")
+	}
+}
+
+func TestConnPoolTestOnBorrowExpiresDeadConnection(t *testing.T) {
+	dials := 0
+	factory := func(state *smtp.ConnectionState, username string) (*upstreamConn, error) {
+		dials++
+		return &upstreamConn{}, nil
+	}
+	failingTestOnBorrow := func(c *upstreamConn, t time.Time) error {
+		return errors.New("dead connection")
+	}
+	p := newConnPool(factory, nil, 1, 0, 0, failingTestOnBorrow)
+
+	c1, err := p.Get(nil, "")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	p.Put(c1, false)
+
+	if _, err := p.Get(nil, ""); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if dials != 2 {
+		t.Fatalf("expected the failed TestOnBorrow to force a redial, got %d dials", dials)
+	}
+}
+
+func TestConnPoolRefreshRunsOnIdleReuse(t *testing.T) {
+	factory := func(state *smtp.ConnectionState, username string) (*upstreamConn, error) {
+		return &upstreamConn{}, nil
+	}
+
+	var mu sync.Mutex
+	var gotUsername string
+	refresh := func(c *upstreamConn, state *smtp.ConnectionState, username string) error {
+		mu.Lock()
+		gotUsername = username
+		mu.Unlock()
+		return nil
+	}
+	p := newConnPool(factory, refresh, 1, 0, 0, nil)
+
+	c1, err := p.Get(nil, "first")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	p.Put(c1, false)
+
+	if _, err := p.Get(nil, "second"); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if gotUsername != "second" {
+		t.Fatalf("expected Refresh to see the borrowing session's username %q, got %q", "second", gotUsername)
+	}
+}
+
+func TestConnPoolGetAccountsForFailedDial(t *testing.T) {
+	dialErr := errors.New("dial failed")
+	factory := func(state *smtp.ConnectionState, username string) (*upstreamConn, error) {
+		return &upstreamConn{}, dialErr
+	}
+	p := newConnPool(factory, nil, 0, 1, 0, nil)
+
+	if _, err := p.Get(nil, ""); err != dialErr {
+		t.Fatalf("Get: got %v, want %v", err, dialErr)
+	}
+	if p.active != 0 {
+		t.Fatalf("expected active count to be released after a failed dial, got %d", p.active)
+	}
+
+	// A failed dial must not hold the MaxActive slot it reserved, or a
+	// subsequent Get would block forever waiting on a slot nobody frees.
+	if _, err := p.Get(nil, ""); err != dialErr {
+		t.Fatalf("Get: got %v, want %v", err, dialErr)
+	}
+}
@@ -2,61 +2,247 @@ package proxy
 
 import (
 	"io"
+	"time"
 
 	"github.com/emersion/go-smtp"
 )
 
+// errRequireTLSUnsupported is returned by Mail when the MAIL command
+// requests RequireTLS but the upstream doesn't advertise REQUIRETLS.
+var errRequireTLSUnsupported = &smtp.SMTPError{
+	Code:         504,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 4},
+	Message:      "smtp-proxy: upstream does not support REQUIRETLS",
+}
+
+// errSMTPUTF8Unsupported is returned by Mail when the MAIL command requests
+// UTF8 but the upstream doesn't advertise SMTPUTF8.
+var errSMTPUTF8Unsupported = &smtp.SMTPError{
+	Code:         504,
+	EnhancedCode: smtp.EnhancedCode{5, 6, 7},
+	Message:      "smtp-proxy: upstream does not support SMTPUTF8",
+}
+
 type Session interface {
 	smtp.Session
 	Noop() error
 	Status() *smtp.SMTPError
+	// Statuses returns the per-recipient status of the last Data call,
+	// aligned with the order recipients were added via Rcpt, until the
+	// next Reset clears it. When both the frontend and the upstream speak
+	// LMTP (see LMTPData) these come from the upstream's distinct
+	// per-recipient replies; otherwise a single reply covers the whole
+	// transaction and the same status is repeated for every recipient.
+	Statuses() []*smtp.SMTPError
 }
 
 type session struct {
-	c  *smtp.Client
-	be *Backend
-	st *smtp.SMTPError
+	uc       *upstreamConn
+	be       *Backend
+	st       *smtp.SMTPError
+	pool     *connPool
+	rcpts    []string
+	statuses []*smtp.SMTPError
+	// closed is set once the upstream connection has been aborted mid-
+	// transaction (see abort), so Logout knows not to try to Reset it for
+	// reuse and instead force-closes it back into the pool.
+	closed bool
 }
 
 func (s *session) Reset() {
-	s.c.Reset()
+	s.uc.client.Reset()
+
+	// The server calls Reset after every DATA, not just on an explicit
+	// client RSET, and reuses this same session for the connection's next
+	// message. Without clearing these, a second message's Statuses would be
+	// padded with the previous message's stale recipients and no longer
+	// align with its own Rcpt order.
+	s.rcpts = nil
+	s.statuses = nil
 }
 
 func (s *session) Noop() error {
-	return s.c.Noop()
+	return s.uc.client.Noop()
 }
 
 func (s *session) Mail(from string, opts *smtp.MailOptions) error {
-	return s.c.Mail(from, opts)
+	// Fail fast with a proper 504 instead of letting the upstream client
+	// return a plain error the frontend can only report as a generic 554.
+	//
+	// DSN's Ret/Envid and per-recipient Notify/Orcpt aren't forwarded: the
+	// vendored go-smtp client's MailOptions and Rcpt don't expose them, so
+	// there's nothing to read them from or pass them through with.
+	if opts != nil {
+		if opts.RequireTLS {
+			if ok, _ := s.uc.client.Extension("REQUIRETLS"); !ok {
+				return errRequireTLSUnsupported
+			}
+		}
+		if opts.UTF8 {
+			if ok, _ := s.uc.client.Extension("SMTPUTF8"); !ok {
+				return errSMTPUTF8Unsupported
+			}
+		}
+	}
+
+	return s.uc.client.Mail(from, opts)
 }
 
 func (s *session) Rcpt(to string) error {
-	return s.c.Rcpt(to)
+	if err := s.uc.client.Rcpt(to); err != nil {
+		return err
+	}
+
+	s.rcpts = append(s.rcpts, to)
+	return nil
 }
 
 func (s *session) Data(r io.Reader) error {
-	wc, err := s.c.Data(s.statusCb)
+	wc, err := s.uc.client.Data(s.statusCb)
 	if err != nil {
 		return err
 	}
 
-	_, err = io.Copy(wc, r)
+	// Mail/Rcpt are already bounded by Client.CommandTimeout, set when the
+	// connection was dialed. DATA is different: the body can be arbitrarily
+	// large and is streamed with raw Writes that bypass that timeout
+	// entirely, so a stalled upstream (or a frontend that stops feeding r)
+	// would otherwise hang the copy forever. Bound the whole transfer with
+	// a deadline on the underlying connection instead, using
+	// SubmissionTimeout rather than CommandTimeout since it's the one sized
+	// for a large-body transfer rather than a single command/reply.
+	timeout := s.be.SubmissionTimeout
+	if timeout == 0 {
+		timeout = defaultSubmissionTimeout
+	}
+	if s.uc.conn != nil {
+		s.uc.conn.SetDeadline(time.Now().Add(timeout))
+		defer s.uc.conn.SetDeadline(time.Time{})
+	}
+
+	if _, err := io.Copy(wc, r); err != nil {
+		// The message is incomplete, so wc.Close() would send the
+		// terminating "." and tell the upstream a truncated message is
+		// done. There's no way to RSET mid-DATA without corrupting the
+		// dot-stuffed body stream, so abort the connection outright and let
+		// the pool dial a fresh one next time.
+		s.abort()
+		return err
+	}
+
+	err = wc.Close()
+	if err != nil {
+		s.abort()
+	}
+
+	// Plain SMTP only ever gives us one terminal status for the whole
+	// transaction; mirror it across every recipient so Statuses stays
+	// aligned with Rcpt order regardless of protocol.
+	s.statuses = make([]*smtp.SMTPError, len(s.rcpts))
+	for i := range s.statuses {
+		s.statuses[i] = s.st
+	}
+
+	return err
+}
+
+// abort gives up on the upstream connection after an unrecoverable mid-
+// transaction error, closing it immediately rather than leaving it for
+// Logout to return to the pool.
+func (s *session) abort() {
+	s.uc.Close()
+	s.closed = true
+}
+
+// LMTPData implements smtp.LMTPSession, giving the frontend genuine
+// per-recipient status replies when both it and the upstream speak LMTP.
+func (s *session) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	if !s.be.LMTP {
+		// Upstream can't give us per-recipient replies; fall back to a
+		// single status applied to every recipient, same as the library
+		// itself does for backends that don't implement LMTPSession.
+		err := s.Data(r)
+		for _, rcpt := range s.rcpts {
+			status.SetStatus(rcpt, smtpErrToError(s.st))
+		}
+		return err
+	}
+
+	wc, err := s.uc.client.LMTPData(func(rcpt string, st *smtp.SMTPError) {
+		s.statuses = append(s.statuses, st)
+		status.SetStatus(rcpt, smtpErrToError(st))
+	})
 	if err != nil {
-		wc.Close()
 		return err
 	}
 
-	return wc.Close()
+	timeout := s.be.SubmissionTimeout
+	if timeout == 0 {
+		timeout = defaultSubmissionTimeout
+	}
+	if s.uc.conn != nil {
+		s.uc.conn.SetDeadline(time.Now().Add(timeout))
+		defer s.uc.conn.SetDeadline(time.Time{})
+	}
+
+	if _, err := io.Copy(wc, r); err != nil {
+		s.abort()
+		return err
+	}
+
+	if err := wc.Close(); err != nil {
+		s.abort()
+		return err
+	}
+
+	return nil
 }
 
 func (s *session) Logout() error {
-	return s.c.Quit()
+	if s.closed {
+		// Already aborted mid-transaction; nothing left to reset.
+		s.pool.Put(s.uc, true)
+		return nil
+	}
+
+	if s.pool.MaxIdle == 0 {
+		// Nothing will actually be kept idle, so there's no point resetting
+		// the connection for reuse; QUIT it gracefully like an unpooled
+		// deployment always has, instead of RSET-then-raw-Close.
+		err := s.uc.client.Quit()
+		s.pool.Put(s.uc, true)
+		return err
+	}
+
+	// Reset the connection instead of QUITting it so it can be reused by
+	// the next Login/AnonymousLogin that draws from the same pool.
+	if err := s.uc.client.Reset(); err != nil {
+		s.pool.Put(s.uc, true)
+		return err
+	}
+
+	s.pool.Put(s.uc, false)
+	return nil
 }
 
 func (s *session) Status() *smtp.SMTPError {
 	return s.st
 }
 
+func (s *session) Statuses() []*smtp.SMTPError {
+	return s.statuses
+}
+
 func (s *session) statusCb(status *smtp.SMTPError) {
 	s.st = status
 }
+
+// smtpErrToError converts a possibly-nil *smtp.SMTPError into an error,
+// taking care not to return a non-nil error interface wrapping a nil
+// pointer.
+func smtpErrToError(st *smtp.SMTPError) error {
+	if st == nil {
+		return nil
+	}
+	return st
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// XClientAttrs holds the XCLIENT attributes sent to an upstream that
+// advertises the extension. A zero-value field is omitted from the command.
+type XClientAttrs struct {
+	Name  string
+	Addr  string
+	Port  string
+	Proto string
+	Helo  string
+	Login string
+}
+
+// TrustedClientHeaderFunc lets operators redact or rewrite the XCLIENT
+// attributes newConn would otherwise send upstream, e.g. to drop LOGIN in
+// privacy-sensitive deployments.
+type TrustedClientHeaderFunc func(attrs XClientAttrs) XClientAttrs
+
+// clientAttrs builds the default XCLIENT attributes for state/username, then
+// runs them through Backend.TrustedClientHeaderFunc if set.
+func (be *Backend) clientAttrs(state *smtp.ConnectionState, username string) XClientAttrs {
+	attrs := XClientAttrs{Login: username}
+
+	if state != nil {
+		attrs.Helo = state.Hostname
+
+		if state.RemoteAddr != nil {
+			if host, port, err := net.SplitHostPort(state.RemoteAddr.String()); err == nil {
+				attrs.Addr = host
+				attrs.Port = port
+			}
+			if _, ok := state.RemoteAddr.(*net.TCPAddr); ok {
+				if strings.Contains(attrs.Addr, ":") {
+					attrs.Proto = "TCP6"
+				} else {
+					attrs.Proto = "TCP4"
+				}
+			}
+		}
+	}
+
+	if be.TrustedClientHeaderFunc != nil {
+		attrs = be.TrustedClientHeaderFunc(attrs)
+	}
+
+	return attrs
+}
+
+// sendXCLIENT sends Postfix's XCLIENT command, preserving the original
+// client's IP, HELO name and SASL identity across the proxy hop, and
+// re-issues EHLO as XCLIENT requires.
+//
+// The vendored go-smtp client has no exported way to reparse its cached
+// extension list from the re-issued EHLO's reply, so any extension the
+// upstream only starts advertising post-XCLIENT (most notably AUTH, which
+// login's mechanism selection reads) wouldn't be picked up for the rest of
+// the session via Client.Extension. sendXCLIENT works around this itself by
+// parsing the raw EHLO reply and returning the resulting extension map, nil
+// if there was nothing to send (attrs was empty).
+func sendXCLIENT(c *smtp.Client, localName string, attrs XClientAttrs) (map[string]string, error) {
+	var parts []string
+	add := func(key, value string) {
+		value = sanitizeXClientValue(value)
+		if value != "" {
+			parts = append(parts, key+"="+value)
+		}
+	}
+	add("NAME", attrs.Name)
+	add("ADDR", attrs.Addr)
+	add("PORT", attrs.Port)
+	add("PROTO", attrs.Proto)
+	add("HELO", attrs.Helo)
+	add("LOGIN", attrs.Login)
+	if len(parts) == 0 {
+		return nil, nil
+	}
+
+	if _, err := xclientCmd(c, 220, "XCLIENT %s", strings.Join(parts, " ")); err != nil {
+		return nil, err
+	}
+
+	msg, err := xclientCmd(c, 250, "EHLO %s", localName)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseEHLOExtensions(msg), nil
+}
+
+// parseEHLOExtensions parses a multi-line EHLO reply into its extension map,
+// mirroring the vendored go-smtp client's own (unexported) ehlo() parsing,
+// since that's the only way to read it back after sendXCLIENT's re-issued
+// EHLO without an exported hook into the client.
+func parseEHLOExtensions(msg string) map[string]string {
+	ext := make(map[string]string)
+	lines := strings.Split(msg, "\n")
+	if len(lines) > 1 {
+		lines = lines[1:]
+	}
+	for _, line := range lines {
+		args := strings.SplitN(line, " ", 2)
+		if len(args) > 1 {
+			ext[args[0]] = args[1]
+		} else {
+			ext[args[0]] = ""
+		}
+	}
+	return ext
+}
+
+// sanitizeXClientValue strips CR, LF, space and tab from v. XCLIENT's
+// attributes are space-separated on a single unescaped command line, and
+// attrs.Login in particular comes from the frontend's (base64-decoded,
+// otherwise unconstrained) SASL AUTH payload: without this, a client could
+// authenticate with a username containing embedded CRLF and smuggle extra
+// commands into the upstream connection.
+func sanitizeXClientValue(v string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '\r', '\n', ' ', '\t':
+			return -1
+		}
+		return r
+	}, v)
+}
+
+// xclientCmd sends a raw command over c.Text (exported specifically so
+// callers can add extensions like this one), returns the response message,
+// and converts a negative reply into a *smtp.SMTPError, mirroring how the
+// client's own unexported cmd helper behaves.
+func xclientCmd(c *smtp.Client, expectCode int, format string, args ...interface{}) (string, error) {
+	id, err := c.Text.Cmd(format, args...)
+	if err != nil {
+		return "", err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+
+	_, msg, err := c.Text.ReadResponse(expectCode)
+	if protoErr, ok := err.(*textproto.Error); ok {
+		return "", &smtp.SMTPError{Code: protoErr.Code, Message: protoErr.Msg}
+	}
+	return msg, err
+}